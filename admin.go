@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// startAdminServer serves the /querylog and /stats admin endpoints over
+// plain HTTP, mirroring the kind of introspection AdGuardHome exposes.
+// Both endpoints leak per-client query history, so every request must
+// carry "Authorization: Bearer <token>" matching token; an empty token is
+// refused rather than silently serving the endpoints unauthenticated.
+func startAdminServer(addr string, token string, queryLog *QueryLog) error {
+	if token == "" {
+		return fmt.Errorf("admin HTTP server requires a non-empty admin token")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/querylog", requireAdminToken(token, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, queryLog.Recent())
+	}))
+	mux.HandleFunc("/stats", requireAdminToken(token, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, queryLog.Stats())
+	}))
+
+	zap.L().Info("start admin HTTP server", zap.String("address", addr))
+	return http.ListenAndServe(addr, mux)
+}
+
+// requireAdminToken wraps handler so it only runs for requests carrying an
+// "Authorization: Bearer <token>" header matching token, comparing in
+// constant time to avoid leaking the token through response-time timing.
+func requireAdminToken(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "Bearer "
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, prefix) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, prefix)), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zap.L().Error("fail to encode admin response", zap.Error(err))
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAdminTokenRejectsMissingOrWrongToken(t *testing.T) {
+	var served bool
+	handler := requireAdminToken("s3cret", func(w http.ResponseWriter, r *http.Request) {
+		served = true
+	})
+
+	cases := []struct {
+		name string
+		auth string
+	}{
+		{"missing header", ""},
+		{"wrong token", "Bearer nope"},
+		{"missing Bearer prefix", "s3cret"},
+	}
+	for _, c := range cases {
+		served = false
+		req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		rec := httptest.NewRecorder()
+
+		handler(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: expected 401, got %d", c.name, rec.Code)
+		}
+		if served {
+			t.Fatalf("%s: handler ran despite missing/invalid token", c.name)
+		}
+	}
+}
+
+func TestRequireAdminTokenAllowsMatchingToken(t *testing.T) {
+	var served bool
+	handler := requireAdminToken("s3cret", func(w http.ResponseWriter, r *http.Request) {
+		served = true
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rec := httptest.NewRecorder()
+
+	handler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if !served {
+		t.Fatalf("handler did not run despite a matching token")
+	}
+}
+
+func TestStartAdminServerRefusesEmptyToken(t *testing.T) {
+	if err := startAdminServer(":0", "", NewQueryLog("", 0, 0, 0)); err == nil {
+		t.Fatalf("expected startAdminServer to refuse an empty admin token")
+	}
+}
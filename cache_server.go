@@ -4,89 +4,91 @@ import (
 	"fmt"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
+	"net"
+	"sort"
 	"strings"
-	"sync"
 	"time"
 )
 
-type CacheServer struct {
-	listenAddrs []string
-	servers     []*DNSServer
-	cache       *DNSCache
-}
-
-type DNSServer struct {
-	client *dns.Client
-	addr   string
-}
+// upstreamStrategy selects how CacheServer fans a cache miss out to its
+// configured upstreams.
+type upstreamStrategy string
 
-type DNSCacheItem struct {
-	timeOut time.Time
-	resp    *dns.Msg
-}
-type DNSCache struct {
-	sync.Mutex
-	cache map[string]*DNSCacheItem
-}
+const (
+	// StrategySequential tries each upstream in configured order, as before.
+	StrategySequential upstreamStrategy = "sequential"
+	// StrategyParallel fires the query at every upstream at once and uses
+	// the first successful response.
+	StrategyParallel upstreamStrategy = "parallel"
+	// StrategyFastest tries upstreams in order of lowest observed EWMA
+	// latency first.
+	StrategyFastest upstreamStrategy = "fastest"
+)
 
-func NewDNSCacheItem(resp *dns.Msg) *DNSCacheItem {
-	timeout := time.Now().Add(time.Duration(resp.Answer[0].Header().Ttl) * time.Second)
-	return &DNSCacheItem{timeOut: timeout, resp: resp}
+const defaultUpstreamCooldown = 30 * time.Second
 
+func parseUpstreamStrategy(s string) upstreamStrategy {
+	switch strings.ToLower(s) {
+	case "parallel":
+		return StrategyParallel
+	case "fastest":
+		return StrategyFastest
+	default:
+		return StrategySequential
+	}
 }
 
-func (dci *DNSCacheItem) isTimeout() bool {
-	return time.Now().After(dci.timeOut)
-}
+// CacheServerOptions groups the knobs controlling upstream fanout and
+// abuse protection for a CacheServer.
+type CacheServerOptions struct {
+	Strategy string
+	Cooldown time.Duration
 
-func NewDNSCache() *DNSCache {
-	return &DNSCache{cache: make(map[string]*DNSCacheItem)}
-}
+	// RateLimitQPS/RateLimitBurst configure a per-client-IP token bucket
+	// in front of request processing. RateLimitQPS <= 0 disables it.
+	RateLimitQPS   float64
+	RateLimitBurst float64
 
-func (dc *DNSCache) findResponse(req *dns.Msg) (*dns.Msg, error) {
-	key, err := dc.getKey(req)
-	if err == nil {
-		dc.Lock()
-		defer dc.Unlock()
-		if item, ok := dc.cache[key]; ok {
-			if item.isTimeout() {
-				delete(dc.cache, key)
-			} else {
-				zap.L().Debug("find response from cache", zap.String("req", fmt.Sprintf("%v", req)), zap.String("resp", fmt.Sprintf("%v", item.resp)))
-
-				return item.resp, nil
-			}
+	// RRLQPS/RRLBurst configure Response Rate Limiting, a token bucket
+	// keyed on (client network prefix, qname, qtype) that blunts
+	// reflection/amplification abuse. RRLQPS <= 0 disables it.
+	RRLQPS   float64
+	RRLBurst float64
 
-		}
+	// RefuseAny answers dns.TypeANY questions with an RFC 8482 HINFO
+	// record instead of forwarding them to the cache or upstreams.
+	RefuseAny bool
 
-	}
-	return nil, fmt.Errorf("No response for %v", req)
-}
+	// QueryLogFile, when non-empty, persists every processed query as
+	// rotating JSONL to this path.
+	QueryLogFile      string
+	QueryLogMaxSizeMB int
+	QueryLogBackups   int
+	QueryLogRingSize  int
 
-func (dc *DNSCache) getKey(req *dns.Msg) (string, error) {
-	if len(req.Question) == 1 {
-		question := req.Question[0]
-
-		if question.Qtype == dns.TypeAAAA || question.Qtype == dns.TypeA {
-			return fmt.Sprintf("%s-%d", question.Name, question.Qtype), nil
-		}
-	}
-	return "", fmt.Errorf("No key for %v", req)
+	// AdminAddr, when non-empty, serves /querylog and /stats over HTTP at
+	// this address (e.g. ":8080"). AdminToken must also be set: every
+	// admin request must carry it as "Authorization: Bearer <token>",
+	// since these endpoints expose per-client query history.
+	AdminAddr  string
+	AdminToken string
 }
 
-func (dc *DNSCache) cacheResponse(req *dns.Msg, resp *dns.Msg) {
-	if len(resp.Answer) > 0 {
-		key, err := dc.getKey(req)
-		if err == nil {
-			zap.L().Debug("cache response", zap.String("req", fmt.Sprintf("%v", req)), zap.String("resp", fmt.Sprintf("%v", resp)))
-			item := NewDNSCacheItem(resp)
-			dc.Lock()
-			defer dc.Unlock()
+type CacheServer struct {
+	listenAddrs []string
+	servers     []*DNSServer
+	cache       *DNSCache
+	strategy    upstreamStrategy
+	cooldown    time.Duration
+	inflight    *singleflightGroup
 
-			dc.cache[key] = item
+	rateLimiter *RateLimiter
+	rrl         *RateLimiter
+	refuseAny   bool
 
-		}
-	}
+	queryLog   *QueryLog
+	adminAddr  string
+	adminToken string
 }
 
 func parseListenAddr(listenAddr string) (proto string, addr string, err error) {
@@ -99,25 +101,7 @@ func parseListenAddr(listenAddr string) (proto string, addr string, err error) {
 	}
 }
 
-func parseDNSServerAddr(dnsServerAddr string) (proto string, addr string, err error) {
-	return parseListenAddr(dnsServerAddr)
-}
-
-func NewDNSServer(server string) (*DNSServer, error) {
-	proto, addr, err := parseDNSServerAddr(server)
-	if err != nil {
-		zap.L().Error("fail to parse server address", zap.String("address", server))
-		return nil, err
-	}
-	return &DNSServer{client: &dns.Client{Net: proto}, addr: addr}, nil
-}
-
-func (ds *DNSServer) Exchange(req *dns.Msg) (*dns.Msg, error) {
-	resp, _, err := ds.client.Exchange(req, ds.addr)
-	return resp, err
-}
-
-func NewCacheServer(listenAddrs []string, servers []string) *CacheServer {
+func NewCacheServer(listenAddrs []string, servers []string, cacheOptions DNSCacheOptions, serverOptions CacheServerOptions) *CacheServer {
 	dnsServers := make([]*DNSServer, 0)
 	for _, server := range servers {
 		dnsServer, err := NewDNSServer(server)
@@ -128,10 +112,49 @@ func NewCacheServer(listenAddrs []string, servers []string) *CacheServer {
 		dnsServers = append(dnsServers, dnsServer)
 	}
 
-	return &CacheServer{listenAddrs: listenAddrs, servers: dnsServers, cache: NewDNSCache()}
+	cooldown := serverOptions.Cooldown
+	if cooldown <= 0 {
+		cooldown = defaultUpstreamCooldown
+	}
+
+	cs := &CacheServer{
+		listenAddrs: listenAddrs,
+		servers:     dnsServers,
+		cache:       NewDNSCache(cacheOptions),
+		strategy:    parseUpstreamStrategy(serverOptions.Strategy),
+		cooldown:    cooldown,
+		inflight:    newSingleflightGroup(),
+		refuseAny:   serverOptions.RefuseAny,
+		adminAddr:   serverOptions.AdminAddr,
+		adminToken:  serverOptions.AdminToken,
+	}
+	cs.cache.SetRefreshFunc(func(req *dns.Msg) (*dns.Msg, error) {
+		resp, _, err := cs.refreshUpstream(req)
+		return resp, err
+	})
+
+	if serverOptions.RateLimitQPS > 0 {
+		cs.rateLimiter = NewRateLimiter(serverOptions.RateLimitQPS, serverOptions.RateLimitBurst)
+	}
+	if serverOptions.RRLQPS > 0 {
+		cs.rrl = NewRateLimiter(serverOptions.RRLQPS, serverOptions.RRLBurst)
+	}
+	if serverOptions.QueryLogFile != "" || serverOptions.AdminAddr != "" {
+		cs.queryLog = NewQueryLog(serverOptions.QueryLogFile, serverOptions.QueryLogMaxSizeMB, serverOptions.QueryLogBackups, serverOptions.QueryLogRingSize)
+	}
+
+	return cs
 }
 
 func (cs *CacheServer) start() error {
+	if cs.queryLog != nil && cs.adminAddr != "" {
+		go func() {
+			if err := startAdminServer(cs.adminAddr, cs.adminToken, cs.queryLog); err != nil {
+				zap.L().Error("fail to start admin HTTP server", zap.String("address", cs.adminAddr), zap.Error(err))
+			}
+		}()
+	}
+
 	for _, listenAddr := range cs.listenAddrs {
 		proto, addr, err := parseListenAddr(listenAddr)
 		if err != nil {
@@ -171,21 +194,245 @@ func (cs *CacheServer) startTCPServer(addr string) error {
 }
 
 func (cs *CacheServer) processDNSMsg(w dns.ResponseWriter, req *dns.Msg) {
+	start := time.Now()
 	zap.L().Debug("process request", zap.String("request", fmt.Sprintf("%v", req)))
+
+	client := clientIP(w.RemoteAddr())
+	if cs.rateLimiter != nil && !cs.rateLimiter.Allow(client.String()) {
+		zap.L().Warn("client exceeded rate limit", zap.String("client", client.String()))
+		resp := servfail(req)
+		w.WriteMsg(resp)
+		cs.logQuery(client, req, resp, start, false, "")
+		return
+	}
+
+	if cs.refuseAny && isAnyQuery(req) {
+		resp := refuseAnyResponse(req)
+		w.WriteMsg(resp)
+		cs.logQuery(client, req, resp, start, false, "")
+		return
+	}
+
+	if cs.rrl != nil && len(req.Question) == 1 && !cs.rrl.Allow(rrlKey(client, req.Question[0])) {
+		zap.L().Debug("response rate limited", zap.String("client", client.String()), zap.String("request", fmt.Sprintf("%v", req)))
+		return
+	}
+
 	resp, err := cs.cache.findResponse(req)
 	if err == nil {
 		resp.Id = req.Id
 		w.WriteMsg(resp)
+		cs.logQuery(client, req, resp, start, true, "")
+		return
+	}
+
+	resp, upstream, err := cs.refreshUpstream(req)
+	if err == nil {
+		cs.cache.cacheResponse(req, resp)
+		zap.L().Info("succeed to get response", zap.String("response", fmt.Sprintf("%v", resp)))
+		w.WriteMsg(resp)
+		cs.logQuery(client, req, resp, start, false, upstream)
+		return
+	}
+	zap.L().Error("fail to process request", zap.String("request", fmt.Sprintf("%v", req)))
+	cs.logQuery(client, req, nil, start, false, "")
+}
+
+// logQuery records a processed request to the query log, if one is
+// configured.
+func (cs *CacheServer) logQuery(client net.IP, req *dns.Msg, resp *dns.Msg, start time.Time, cacheHit bool, upstream string) {
+	if cs.queryLog == nil || len(req.Question) == 0 {
 		return
 	}
+
+	entry := QueryLogEntry{
+		Time:      start,
+		Client:    client.String(),
+		QName:     req.Question[0].Name,
+		QType:     dns.TypeToString[req.Question[0].Qtype],
+		Upstream:  upstream,
+		ElapsedMs: float64(time.Since(start)) / float64(time.Millisecond),
+		CacheHit:  cacheHit,
+	}
+	if resp != nil {
+		entry.Rcode = dns.RcodeToString[resp.Rcode]
+		entry.Answer = answerSummary(resp)
+	} else {
+		entry.Rcode = dns.RcodeToString[dns.RcodeServerFailure]
+	}
+	cs.queryLog.Record(entry)
+}
+
+// rrlKey identifies a response for Response Rate Limiting purposes: the
+// client's network prefix together with the question being asked.
+func rrlKey(client net.IP, question dns.Question) string {
+	return fmt.Sprintf("%s-%s-%d", clientPrefix(client), strings.ToLower(question.Name), question.Qtype)
+}
+
+// isAnyQuery reports whether req is a single dns.TypeANY question.
+func isAnyQuery(req *dns.Msg) bool {
+	return len(req.Question) == 1 && req.Question[0].Qtype == dns.TypeANY
+}
+
+// refuseAnyResponse answers an ANY question with a single HINFO record as
+// recommended by RFC 8482, instead of forwarding it to the cache or
+// upstreams.
+func refuseAnyResponse(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.HINFO{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: 86400},
+		Cpu: "RFC8482",
+		Os:  "",
+	})
+	return resp
+}
+
+// servfail builds a SERVFAIL response to req, used when a client is being
+// rate limited.
+func servfail(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeServerFailure)
+	return resp
+}
+
+// exchangeResult bundles an upstream's answer together with which upstream
+// produced it, so callers sharing a deduplicated refreshUpstream call all
+// see the same information.
+type exchangeResult struct {
+	resp     *dns.Msg
+	upstream string
+}
+
+// refreshUpstream exchanges req with the upstreams, deduplicating
+// concurrent callers asking for the same question so a cache-miss storm or
+// a prefetch racing a live query never causes more than one upstream call.
+func (cs *CacheServer) refreshUpstream(req *dns.Msg) (*dns.Msg, string, error) {
+	val, err := cs.inflight.Do(cs.singleflightKey(req), func() (interface{}, error) {
+		resp, upstream, err := cs.exchange(req)
+		return exchangeResult{resp: resp, upstream: upstream}, err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	result := val.(exchangeResult)
+	return result.resp, result.upstream, nil
+}
+
+// singleflightKey identifies req for deduplication purposes, matching the
+// same (qname, qtype, qclass, ECS network) granularity as the cache itself.
+func (cs *CacheServer) singleflightKey(req *dns.Msg) string {
+	key, ecs, err := cs.cache.getKey(req)
+	if err != nil {
+		return fmt.Sprintf("%p", req)
+	}
+	if ecs != nil {
+		return fmt.Sprintf("%s-%s/%d", key, ecs.Address, ecs.SourceNetmask)
+	}
+	return key
+}
+
+// exchange fans req out to the configured upstreams following cs.strategy,
+// skipping any upstream that is currently in cooldown after repeated
+// failures. It returns the response together with the address of the
+// upstream that produced it.
+func (cs *CacheServer) exchange(req *dns.Msg) (*dns.Msg, string, error) {
+	servers := cs.availableServers()
+
+	switch cs.strategy {
+	case StrategyParallel:
+		return cs.exchangeParallel(req, servers)
+	case StrategyFastest:
+		return cs.exchangeFastest(req, servers)
+	default:
+		return cs.exchangeSequential(req, servers)
+	}
+}
+
+// availableServers returns the configured upstreams that are not currently
+// in cooldown, falling back to the full list if every upstream is down so
+// a request is never given up on outright.
+func (cs *CacheServer) availableServers() []*DNSServer {
+	servers := make([]*DNSServer, 0, len(cs.servers))
 	for _, server := range cs.servers {
-		resp, err := server.Exchange(req)
+		if server.health.available() {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		return cs.servers
+	}
+	return servers
+}
+
+// exchangeOne performs a single upstream exchange, recording the outcome on
+// the upstream's health record.
+func (cs *CacheServer) exchangeOne(server *DNSServer, req *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := server.Exchange(req)
+	if err != nil {
+		server.health.recordFailure(cs.cooldown)
+		return nil, err
+	}
+	server.health.recordSuccess(time.Since(start))
+	return resp, nil
+}
+
+func (cs *CacheServer) exchangeSequential(req *dns.Msg, servers []*DNSServer) (*dns.Msg, string, error) {
+	var lastErr error
+	for _, server := range servers {
+		resp, err := cs.exchangeOne(server, req)
 		if err == nil {
-			cs.cache.cacheResponse(req, resp)
-			zap.L().Info("succeed to get response", zap.String("response", fmt.Sprintf("%v", resp)))
-			w.WriteMsg(resp)
-			return
+			return resp, server.addr, nil
 		}
+		lastErr = err
 	}
-	zap.L().Error("fail to process request", zap.String("request", fmt.Sprintf("%v", req)))
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no upstream configured")
+	}
+	return nil, "", lastErr
+}
+
+// exchangeFastest tries upstreams in order of lowest observed EWMA latency,
+// falling back to the next one on failure.
+func (cs *CacheServer) exchangeFastest(req *dns.Msg, servers []*DNSServer) (*dns.Msg, string, error) {
+	ordered := make([]*DNSServer, len(servers))
+	copy(ordered, servers)
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].health.avgLatency() < ordered[j].health.avgLatency()
+	})
+	return cs.exchangeSequential(req, ordered)
+}
+
+// exchangeParallel fires req at every upstream concurrently and returns the
+// first successful response. The slower goroutines are left to finish in
+// the background; their results are simply discarded.
+func (cs *CacheServer) exchangeParallel(req *dns.Msg, servers []*DNSServer) (*dns.Msg, string, error) {
+	type result struct {
+		resp     *dns.Msg
+		upstream string
+		err      error
+	}
+
+	results := make(chan result, len(servers))
+	for _, server := range servers {
+		server := server
+		go func() {
+			resp, err := cs.exchangeOne(server, req)
+			results <- result{resp: resp, upstream: server.addr, err: err}
+		}()
+	}
+
+	var lastErr error
+	for range servers {
+		r := <-results
+		if r.err == nil {
+			return r.resp, r.upstream, nil
+		}
+		lastErr = r.err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no upstream configured")
+	}
+	return nil, "", lastErr
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// fakeResponseWriter is a minimal dns.ResponseWriter that just records the
+// message it was asked to write, so processDNSMsg can be driven in tests
+// without a real socket.
+type fakeResponseWriter struct {
+	remoteAddr net.Addr
+	msg        *dns.Msg
+}
+
+func (w *fakeResponseWriter) LocalAddr() net.Addr         { return w.remoteAddr }
+func (w *fakeResponseWriter) RemoteAddr() net.Addr        { return w.remoteAddr }
+func (w *fakeResponseWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *fakeResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *fakeResponseWriter) Close() error                { return nil }
+func (w *fakeResponseWriter) TsigStatus() error           { return nil }
+func (w *fakeResponseWriter) TsigTimersOnly(bool)         {}
+func (w *fakeResponseWriter) Hijack()                     {}
+
+func TestProcessDNSMsgRateLimitsPerClient(t *testing.T) {
+	cs := NewCacheServer(nil, nil, DNSCacheOptions{}, CacheServerOptions{RateLimitQPS: 1, RateLimitBurst: 1})
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+
+	first := &fakeResponseWriter{remoteAddr: client}
+	cs.processDNSMsg(first, questionMsg("example.", dns.TypeA))
+	if first.msg != nil {
+		t.Fatalf("expected the first request within the burst to fall through (no upstream configured, no synthetic response), got %v", first.msg)
+	}
+
+	second := &fakeResponseWriter{remoteAddr: client}
+	cs.processDNSMsg(second, questionMsg("example.", dns.TypeA))
+	if second.msg == nil || second.msg.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("expected the second request to be rate limited with SERVFAIL, got %v", second.msg)
+	}
+}
+
+func TestProcessDNSMsgAppliesResponseRateLimiting(t *testing.T) {
+	cs := NewCacheServer(nil, nil, DNSCacheOptions{}, CacheServerOptions{
+		RRLQPS: 1, RRLBurst: 1,
+		AdminAddr: ":0", AdminToken: "t", QueryLogRingSize: 10,
+	})
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+
+	cs.processDNSMsg(&fakeResponseWriter{remoteAddr: client}, questionMsg("example.", dns.TypeA))
+	if got := len(cs.queryLog.Recent()); got != 1 {
+		t.Fatalf("expected the first request within the RRL burst to be logged, got %d entries", got)
+	}
+
+	cs.processDNSMsg(&fakeResponseWriter{remoteAddr: client}, questionMsg("example.", dns.TypeA))
+	if got := len(cs.queryLog.Recent()); got != 1 {
+		t.Fatalf("expected the second, RRL-dropped request to leave no log entry, got %d entries", got)
+	}
+}
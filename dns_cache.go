@@ -0,0 +1,398 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMaxEntries                  = 10000
+	defaultMaxTTL                      = 24 * 60 * 60
+	defaultNegativeTTL                 = 60
+	defaultPrefetchBeforeExpiryPercent = 10
+)
+
+// DNSCacheOptions configures the size, TTL bounds and prefetch behaviour of
+// a DNSCache. Zero values fall back to sane defaults.
+type DNSCacheOptions struct {
+	MaxEntries  int
+	MinTTL      uint32
+	MaxTTL      uint32
+	NegativeTTL uint32
+
+	// PrefetchEnabled opts into refreshing hot entries before they expire.
+	PrefetchEnabled bool
+	// PrefetchMinHits is the number of cache hits an entry must accumulate
+	// before it becomes eligible for prefetch.
+	PrefetchMinHits int64
+	// PrefetchBeforeExpiryPercent is how close to expiry, as a percentage
+	// of the entry's original TTL, a prefetch is triggered.
+	PrefetchBeforeExpiryPercent int
+}
+
+func (o DNSCacheOptions) withDefaults() DNSCacheOptions {
+	if o.MaxEntries <= 0 {
+		o.MaxEntries = defaultMaxEntries
+	}
+	if o.MaxTTL <= 0 {
+		o.MaxTTL = defaultMaxTTL
+	}
+	if o.NegativeTTL <= 0 {
+		o.NegativeTTL = defaultNegativeTTL
+	}
+	if o.PrefetchBeforeExpiryPercent <= 0 {
+		o.PrefetchBeforeExpiryPercent = defaultPrefetchBeforeExpiryPercent
+	}
+	return o
+}
+
+// DNSCacheItem is a single cached answer together with the time it expires.
+// ecsNetwork is set when the answer was scoped to an EDNS Client Subnet
+// network (RFC 7871) and must only be served to clients within it.
+type DNSCacheItem struct {
+	key         string
+	ecsNetwork  *net.IPNet
+	req         *dns.Msg
+	timeOut     time.Time
+	originalTTL uint32
+	resp        *dns.Msg
+
+	hits        int64
+	prefetching int32
+}
+
+func NewDNSCacheItem(key string, ecsNetwork *net.IPNet, req *dns.Msg, resp *dns.Msg, ttl uint32) *DNSCacheItem {
+	return &DNSCacheItem{
+		key:         key,
+		ecsNetwork:  ecsNetwork,
+		req:         req,
+		timeOut:     time.Now().Add(time.Duration(ttl) * time.Second),
+		originalTTL: ttl,
+		resp:        resp,
+	}
+}
+
+func (dci *DNSCacheItem) isTimeout() bool {
+	return time.Now().After(dci.timeOut)
+}
+
+// cacheBucket groups every cached answer for one (qname, qtype, qclass):
+// at most one plain (non-ECS) entry, plus zero or more entries scoped to
+// distinct client subnets.
+type cacheBucket struct {
+	plain *list.Element
+	ecs   []*list.Element
+}
+
+// DNSCache is a size-bounded LRU cache of DNS responses. Negative
+// (NXDOMAIN/NODATA) responses are cached too, per RFC 2308, and every
+// returned answer has its TTLs rewritten to reflect the time remaining
+// until expiry. Entries keyed with an EDNS Client Subnet option are only
+// served to clients whose address falls within the cached scope.
+type DNSCache struct {
+	sync.Mutex
+	options DNSCacheOptions
+	entries map[string]*cacheBucket
+	order   *list.List
+
+	// refresh re-queries the upstreams for req, used to prefetch hot
+	// entries before they expire. Left nil, prefetch is a no-op.
+	refresh func(req *dns.Msg) (*dns.Msg, error)
+}
+
+func NewDNSCache(options DNSCacheOptions) *DNSCache {
+	options = options.withDefaults()
+	return &DNSCache{
+		options: options,
+		entries: make(map[string]*cacheBucket),
+		order:   list.New(),
+	}
+}
+
+// SetRefreshFunc wires the upstream re-query used by the prefetch
+// subsystem. CacheServer calls this once after constructing the cache.
+func (dc *DNSCache) SetRefreshFunc(refresh func(req *dns.Msg) (*dns.Msg, error)) {
+	dc.refresh = refresh
+}
+
+func (dc *DNSCache) findResponse(req *dns.Msg) (*dns.Msg, error) {
+	key, ecs, err := dc.getKey(req)
+	if err != nil {
+		return nil, err
+	}
+
+	dc.Lock()
+	bucket, ok := dc.entries[key]
+	if !ok {
+		dc.Unlock()
+		return nil, fmt.Errorf("No response for %v", req)
+	}
+
+	elem := dc.findElement(bucket, ecs)
+	if elem == nil {
+		dc.Unlock()
+		return nil, fmt.Errorf("No response for %v", req)
+	}
+
+	item := elem.Value.(*DNSCacheItem)
+	if item.isTimeout() {
+		dc.removeElement(elem)
+		dc.Unlock()
+		return nil, fmt.Errorf("No response for %v", req)
+	}
+	dc.order.MoveToFront(elem)
+	resp := item.resp.Copy()
+	remaining := time.Until(item.timeOut)
+	dc.Unlock()
+
+	hits := atomic.AddInt64(&item.hits, 1)
+	if dc.options.PrefetchEnabled {
+		dc.maybePrefetch(item, hits, remaining)
+	}
+
+	rewriteTTL(resp, uint32(remaining.Seconds()))
+	zap.L().Debug("find response from cache", zap.String("req", fmt.Sprintf("%v", req)), zap.String("resp", fmt.Sprintf("%v", resp)))
+	return resp, nil
+}
+
+// maybePrefetch spawns a background refresh of item once it has been
+// requested at least PrefetchMinHits times and is within
+// PrefetchBeforeExpiryPercent of its original TTL. At most one prefetch
+// runs per item at a time.
+func (dc *DNSCache) maybePrefetch(item *DNSCacheItem, hits int64, remaining time.Duration) {
+	if hits < dc.options.PrefetchMinHits {
+		return
+	}
+
+	threshold := time.Duration(item.originalTTL) * time.Second * time.Duration(dc.options.PrefetchBeforeExpiryPercent) / 100
+	if remaining > threshold {
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&item.prefetching, 0, 1) {
+		return
+	}
+	go dc.prefetch(item)
+}
+
+// prefetch re-queries the upstreams for item.req and swaps the refreshed
+// answer into the cache in its place.
+func (dc *DNSCache) prefetch(item *DNSCacheItem) {
+	defer atomic.StoreInt32(&item.prefetching, 0)
+
+	if dc.refresh == nil {
+		return
+	}
+
+	resp, err := dc.refresh(item.req)
+	if err != nil {
+		zap.L().Warn("fail to prefetch cache entry", zap.String("req", fmt.Sprintf("%v", item.req)), zap.Error(err))
+		return
+	}
+
+	zap.L().Debug("prefetched cache entry", zap.String("req", fmt.Sprintf("%v", item.req)))
+	dc.cacheResponse(item.req, resp)
+}
+
+// findElement looks up the entry in bucket matching the client network
+// described by ecs, or the plain entry when ecs is nil. The caller must
+// hold dc.Mutex.
+func (dc *DNSCache) findElement(bucket *cacheBucket, ecs *dns.EDNS0_SUBNET) *list.Element {
+	if ecs == nil {
+		return bucket.plain
+	}
+	for _, elem := range bucket.ecs {
+		item := elem.Value.(*DNSCacheItem)
+		if item.ecsNetwork != nil && item.ecsNetwork.Contains(ecs.Address) {
+			return elem
+		}
+	}
+	return nil
+}
+
+// getKey returns the cache key for req's question -- the lowercased qname,
+// qtype and qclass -- together with the EDNS Client Subnet option attached
+// to req, if any.
+func (dc *DNSCache) getKey(req *dns.Msg) (string, *dns.EDNS0_SUBNET, error) {
+	if len(req.Question) != 1 {
+		return "", nil, fmt.Errorf("No key for %v", req)
+	}
+	question := req.Question[0]
+	key := fmt.Sprintf("%s-%d-%d", strings.ToLower(question.Name), question.Qtype, question.Qclass)
+	return key, getECS(req), nil
+}
+
+// cacheResponse stores resp, including negative (NXDOMAIN/NODATA) answers,
+// clamping its effective TTL to [MinTTL,MaxTTL]. When the query carried an
+// EDNS Client Subnet option, the entry is scoped to the network reported by
+// the upstream's SCOPE PREFIX-LENGTH (or the client's own source prefix if
+// the upstream did not echo one back), so it is never served outside that
+// network.
+func (dc *DNSCache) cacheResponse(req *dns.Msg, resp *dns.Msg) {
+	key, ecsQuery, err := dc.getKey(req)
+	if err != nil {
+		return
+	}
+
+	ttl, cacheable := dc.effectiveTTL(resp)
+	if !cacheable {
+		return
+	}
+
+	var ecsNetwork *net.IPNet
+	if ecsQuery != nil {
+		scope := ecsQuery.SourceNetmask
+		if ecsResp := getECS(resp); ecsResp != nil && ecsResp.SourceScope > 0 {
+			scope = ecsResp.SourceScope
+		}
+		ecsNetwork = maskNetwork(ecsQuery.Address, scope, ecsQuery.Family)
+	}
+
+	zap.L().Debug("cache response", zap.String("req", fmt.Sprintf("%v", req)), zap.String("resp", fmt.Sprintf("%v", resp)))
+	item := NewDNSCacheItem(key, ecsNetwork, req.Copy(), resp.Copy(), ttl)
+
+	dc.Lock()
+	defer dc.Unlock()
+
+	bucket, ok := dc.entries[key]
+	if !ok {
+		bucket = &cacheBucket{}
+		dc.entries[key] = bucket
+	}
+
+	if existing := dc.findElement(bucket, ecsQuery); existing != nil {
+		dc.removeElement(existing)
+		bucket = dc.entries[key]
+		if bucket == nil {
+			bucket = &cacheBucket{}
+			dc.entries[key] = bucket
+		}
+	}
+
+	elem := dc.order.PushFront(item)
+	if ecsNetwork == nil {
+		bucket.plain = elem
+	} else {
+		bucket.ecs = append(bucket.ecs, elem)
+	}
+
+	for dc.order.Len() > dc.options.MaxEntries {
+		dc.removeElement(dc.order.Back())
+	}
+}
+
+// effectiveTTL computes the TTL a response should be cached for, clamped to
+// [MinTTL,MaxTTL]. Negative responses (NXDOMAIN, or NOERROR with no answer)
+// are cached using the SOA MINIMUM field per RFC 2308, falling back to
+// NegativeTTL when no SOA record is present.
+func (dc *DNSCache) effectiveTTL(resp *dns.Msg) (uint32, bool) {
+	var ttl uint32
+
+	if len(resp.Answer) > 0 {
+		ttl = resp.Answer[0].Header().Ttl
+		for _, rr := range resp.Answer[1:] {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	} else if resp.Rcode == dns.RcodeNameError || resp.Rcode == dns.RcodeSuccess {
+		ttl = dc.options.NegativeTTL
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = soa.Minttl
+				break
+			}
+		}
+	} else {
+		return 0, false
+	}
+
+	if ttl < dc.options.MinTTL {
+		ttl = dc.options.MinTTL
+	}
+	if ttl > dc.options.MaxTTL {
+		ttl = dc.options.MaxTTL
+	}
+	return ttl, true
+}
+
+// removeElement deletes elem from both the LRU list and its bucket.
+// The caller must hold dc.Mutex.
+func (dc *DNSCache) removeElement(elem *list.Element) {
+	item := elem.Value.(*DNSCacheItem)
+	dc.order.Remove(elem)
+
+	bucket, ok := dc.entries[item.key]
+	if !ok {
+		return
+	}
+	if bucket.plain == elem {
+		bucket.plain = nil
+	}
+	for i, e := range bucket.ecs {
+		if e == elem {
+			bucket.ecs = append(bucket.ecs[:i], bucket.ecs[i+1:]...)
+			break
+		}
+	}
+	if bucket.plain == nil && len(bucket.ecs) == 0 {
+		delete(dc.entries, item.key)
+	}
+}
+
+// rewriteTTL overwrites the TTL of every resource record in resp with
+// remaining, so a downstream resolver observes a decreasing TTL rather
+// than the value that was true when the response was first cached.
+func rewriteTTL(resp *dns.Msg, remaining uint32) {
+	for _, rr := range resp.Answer {
+		rr.Header().Ttl = remaining
+	}
+	for _, rr := range resp.Ns {
+		rr.Header().Ttl = remaining
+	}
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			rr.Header().Ttl = remaining
+		}
+	}
+}
+
+// getECS returns the EDNS Client Subnet option (RFC 7871) attached to msg's
+// OPT record, or nil if msg carries no ECS option.
+func getECS(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// maskNetwork masks ip to its leading prefixLen bits, returning the network
+// that prefix describes for the given ECS address family (1 = IPv4, 2 =
+// IPv6).
+func maskNetwork(ip net.IP, prefixLen uint8, family uint16) *net.IPNet {
+	bits := 32
+	addr := ip.To4()
+	if family == 2 || addr == nil {
+		bits = 128
+		addr = ip.To16()
+	}
+	if int(prefixLen) > bits {
+		prefixLen = uint8(bits)
+	}
+	mask := net.CIDRMask(int(prefixLen), bits)
+	return &net.IPNet{IP: addr.Mask(mask), Mask: mask}
+}
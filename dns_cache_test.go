@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newTestCache(options DNSCacheOptions) *DNSCache {
+	return NewDNSCache(options)
+}
+
+func questionMsg(name string, qtype uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	return req
+}
+
+func answerMsg(req *dns.Msg, ttl uint32) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP("127.0.0.1"),
+	}}
+	return resp
+}
+
+func TestDNSCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newTestCache(DNSCacheOptions{MaxEntries: 2})
+
+	for _, name := range []string{"a.example.", "b.example.", "c.example."} {
+		req := questionMsg(name, dns.TypeA)
+		cache.cacheResponse(req, answerMsg(req, 300))
+	}
+
+	if _, err := cache.findResponse(questionMsg("a.example.", dns.TypeA)); err == nil {
+		t.Fatalf("expected a.example. to have been evicted once the cache grew past MaxEntries")
+	}
+	if _, err := cache.findResponse(questionMsg("c.example.", dns.TypeA)); err != nil {
+		t.Fatalf("expected c.example. to still be cached: %v", err)
+	}
+}
+
+func TestDNSCacheEffectiveTTLForNegativeResponses(t *testing.T) {
+	cache := newTestCache(DNSCacheOptions{NegativeTTL: 60, MinTTL: 10, MaxTTL: 120})
+
+	resp := new(dns.Msg)
+	resp.Rcode = dns.RcodeNameError
+
+	ttl, cacheable := cache.effectiveTTL(resp)
+	if !cacheable {
+		t.Fatalf("expected an NXDOMAIN response to be cacheable")
+	}
+	if ttl != 60 {
+		t.Fatalf("expected the configured NegativeTTL of 60 absent an SOA record, got %d", ttl)
+	}
+
+	resp.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Rrtype: dns.TypeSOA, Ttl: 3600}, Minttl: 200}}
+	ttl, cacheable = cache.effectiveTTL(resp)
+	if !cacheable {
+		t.Fatalf("expected an NXDOMAIN response with an SOA record to be cacheable")
+	}
+	if ttl != 120 {
+		t.Fatalf("expected the SOA MINIMUM to be clamped to MaxTTL 120, got %d", ttl)
+	}
+}
+
+// setECS attaches an EDNS Client Subnet option (RFC 7871) to msg.
+func setECS(msg *dns.Msg, ip net.IP, sourceNetmask, sourceScope uint8) {
+	opt := new(dns.OPT)
+	opt.Hdr.Name = "."
+	opt.Hdr.Rrtype = dns.TypeOPT
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: sourceNetmask,
+		SourceScope:   sourceScope,
+		Address:       ip,
+	})
+	msg.Extra = append(msg.Extra, opt)
+}
+
+func TestDNSCacheScopesECSEntryToItsNetwork(t *testing.T) {
+	cache := newTestCache(DNSCacheOptions{})
+
+	req := questionMsg("example.", dns.TypeA)
+	setECS(req, net.ParseIP("203.0.113.10"), 24, 0)
+	resp := answerMsg(req, 300)
+	setECS(resp, net.ParseIP("203.0.113.10"), 24, 24)
+	cache.cacheResponse(req, resp)
+
+	inNetwork := questionMsg("example.", dns.TypeA)
+	setECS(inNetwork, net.ParseIP("203.0.113.99"), 24, 0)
+	if _, err := cache.findResponse(inNetwork); err != nil {
+		t.Fatalf("expected a client inside the cached /24 to hit: %v", err)
+	}
+
+	outOfNetwork := questionMsg("example.", dns.TypeA)
+	setECS(outOfNetwork, net.ParseIP("198.51.100.5"), 24, 0)
+	if _, err := cache.findResponse(outOfNetwork); err == nil {
+		t.Fatalf("expected a client outside the cached /24 to miss")
+	}
+}
+
+func TestDNSCacheKeysOnQtype(t *testing.T) {
+	cache := newTestCache(DNSCacheOptions{})
+
+	aReq := questionMsg("example.", dns.TypeA)
+	cache.cacheResponse(aReq, answerMsg(aReq, 300))
+
+	if _, err := cache.findResponse(questionMsg("example.", dns.TypeAAAA)); err == nil {
+		t.Fatalf("expected a cached A record not to answer an AAAA query for the same name")
+	}
+	if _, err := cache.findResponse(aReq); err != nil {
+		t.Fatalf("expected the cached A record to still be found: %v", err)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+)
+
+// dohContentType is the wire-format MIME type used by DNS-over-HTTPS,
+// see RFC 8484.
+const dohContentType = "application/dns-message"
+
+// dohTimeout bounds a single DoH round trip so a slow or unresponsive
+// endpoint can't block the caller (and, under the parallel/fastest fanout
+// strategies, a whole exchange slot) indefinitely.
+const dohTimeout = 5 * time.Second
+
+// doqALPN is the ALPN token DoQ servers and clients negotiate, see RFC 9250.
+const doqALPN = "doq"
+
+// tlsPoolSize is the number of DoT connections kept open per upstream, so
+// concurrent queries don't serialize onto a single shared socket.
+const tlsPoolSize = 4
+
+// DNSServer is a single upstream resolver. It may speak plain UDP/TCP,
+// DNS-over-TLS, DNS-over-HTTPS or DNS-over-QUIC depending on the scheme
+// the server address was configured with.
+type DNSServer struct {
+	proto string
+	addr  string
+
+	// udp/tcp/tls
+	client *dns.Client
+
+	// tls: a small pool of ready connections, so concurrent queries don't
+	// serialize onto a single shared socket
+	tlsPool chan *dns.Conn
+
+	// https (DoH)
+	httpClient *http.Client
+	httpURL    string
+
+	// quic (DoQ)
+	quicTLSConfig *tls.Config
+	quicMutex     sync.Mutex
+	quicConn      quic.Connection
+
+	health *upstreamHealth
+}
+
+// parseDNSServerAddr parses a configured upstream address and returns the
+// transport to use together with the address/URL to dial. In addition to
+// the historical "udp:"/"tcp:" prefixes, it understands the URL-style
+// schemes "tls://", "https://" and "quic://" used for DoT, DoH and DoQ.
+func parseDNSServerAddr(dnsServerAddr string) (proto string, addr string, err error) {
+	if strings.Contains(dnsServerAddr, "://") {
+		u, err := url.Parse(dnsServerAddr)
+		if err != nil {
+			return "", "", err
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "tls":
+			return "tls", u.Host, nil
+		case "https":
+			return "https", dnsServerAddr, nil
+		case "quic":
+			return "quic", u.Host, nil
+		default:
+			return "", "", fmt.Errorf("unsupported scheme %s in %s", u.Scheme, dnsServerAddr)
+		}
+	}
+	return parseListenAddr(dnsServerAddr)
+}
+
+// NewDNSServer creates the upstream client matching the scheme of server.
+func NewDNSServer(server string) (*DNSServer, error) {
+	proto, addr, err := parseDNSServerAddr(server)
+	if err != nil {
+		zap.L().Error("fail to parse server address", zap.String("address", server))
+		return nil, err
+	}
+
+	ds := &DNSServer{proto: proto, addr: addr, health: newUpstreamHealth()}
+
+	switch proto {
+	case "udp", "tcp":
+		ds.client = &dns.Client{Net: proto}
+	case "tls":
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		ds.client = &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{ServerName: host}}
+		ds.tlsPool = make(chan *dns.Conn, tlsPoolSize)
+	case "https":
+		ds.httpURL = addr
+		ds.httpClient = &http.Client{Timeout: dohTimeout}
+	case "quic":
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		ds.quicTLSConfig = &tls.Config{ServerName: host, NextProtos: []string{doqALPN}}
+	default:
+		return nil, fmt.Errorf("unsupported protocol %s", proto)
+	}
+
+	return ds, nil
+}
+
+// Exchange sends req to the upstream and returns its response, dispatching
+// to the transport matching how the server was configured.
+func (ds *DNSServer) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	switch ds.proto {
+	case "tls":
+		return ds.exchangeTLS(req)
+	case "https":
+		return ds.exchangeDoH(req)
+	case "quic":
+		return ds.exchangeDoQ(req)
+	default:
+		resp, _, err := ds.client.Exchange(req, ds.addr)
+		return resp, err
+	}
+}
+
+// exchangeTLS exchanges req over a pooled DoT connection, dialing a fresh
+// one when the pool is empty, so concurrent queries never serialize onto
+// one shared socket. The number of queries in flight is not capped; at most
+// tlsPoolSize idle connections are kept for reuse. A connection that errors
+// is dropped rather than returned to the pool.
+func (ds *DNSServer) exchangeTLS(req *dns.Msg) (*dns.Msg, error) {
+	conn, err := ds.getTLSConn()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, _, err := ds.client.ExchangeWithConn(req, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ds.putTLSConn(conn)
+	return resp, nil
+}
+
+// getTLSConn returns a pooled DoT connection, dialing a new one if the
+// pool is currently empty.
+func (ds *DNSServer) getTLSConn() (*dns.Conn, error) {
+	select {
+	case conn := <-ds.tlsPool:
+		return conn, nil
+	default:
+		return ds.client.Dial(ds.addr)
+	}
+}
+
+// putTLSConn returns conn to the pool, closing it instead if the pool is
+// already full.
+func (ds *DNSServer) putTLSConn(conn *dns.Conn) {
+	select {
+	case ds.tlsPool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// exchangeDoH POSTs the wire-format message to the DoH endpoint and parses
+// the response body back into a dns.Msg, as described in RFC 8484.
+func (ds *DNSServer) exchangeDoH(req *dns.Msg) (*dns.Msg, error) {
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, ds.httpURL, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", dohContentType)
+	httpReq.Header.Set("Accept", dohContentType)
+
+	httpResp, err := ds.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH query to %s failed with status %s", ds.httpURL, httpResp.Status)
+	}
+
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &dns.Msg{}
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// exchangeDoQ sends req over a dedicated QUIC stream and reads the reply
+// back. Unlike DNS-over-TCP, RFC 9250 does not length-prefix the message:
+// each query/response is framed by its own stream, terminated by the
+// sender closing its write side.
+func (ds *DNSServer) exchangeDoQ(req *dns.Msg) (*dns.Msg, error) {
+	conn, err := ds.getQuicConn()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		ds.closeQuicConn()
+		return nil, err
+	}
+	defer stream.Close()
+
+	// RFC 9250 section 4.2.1 requires the message ID to be 0 on the wire,
+	// since the stream itself (not the ID) correlates query and response.
+	query := req.Copy()
+	query.Id = 0
+
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := stream.Write(packed); err != nil {
+		return nil, err
+	}
+	stream.Close()
+
+	respBuf, err := io.ReadAll(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &dns.Msg{}
+	if err := resp.Unpack(respBuf); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (ds *DNSServer) getQuicConn() (quic.Connection, error) {
+	ds.quicMutex.Lock()
+	defer ds.quicMutex.Unlock()
+
+	if ds.quicConn != nil {
+		return ds.quicConn, nil
+	}
+
+	conn, err := quic.DialAddr(context.Background(), ds.addr, ds.quicTLSConfig, nil)
+	if err != nil {
+		return nil, err
+	}
+	ds.quicConn = conn
+	return conn, nil
+}
+
+func (ds *DNSServer) closeQuicConn() {
+	ds.quicMutex.Lock()
+	defer ds.quicMutex.Unlock()
+
+	if ds.quicConn != nil {
+		ds.quicConn.CloseWithError(0, "")
+		ds.quicConn = nil
+	}
+}
@@ -9,12 +9,33 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 )
 
 type DNSCacheConfig struct {
 	Caches []struct {
-		ListenAddrs []string `yaml:"listenAddrs,omitempty"`
-		DnsServers  []string `yaml:"dnsServers,omitempty"`
+		ListenAddrs      []string `yaml:"listenAddrs,omitempty"`
+		DnsServers       []string `yaml:"dnsServers,omitempty"`
+		MaxEntries       int      `yaml:"maxEntries,omitempty"`
+		MinTTL           uint32   `yaml:"minTTL,omitempty"`
+		MaxTTL           uint32   `yaml:"maxTTL,omitempty"`
+		NegativeTTL      uint32   `yaml:"negativeTTL,omitempty"`
+		UpstreamStrategy string   `yaml:"upstreamStrategy,omitempty"`
+		UpstreamCooldown int      `yaml:"upstreamCooldown,omitempty"`
+		Prefetch         bool     `yaml:"prefetch,omitempty"`
+		PrefetchMinHits  int64    `yaml:"prefetchMinHits,omitempty"`
+		PrefetchPercent  int      `yaml:"prefetchBeforeExpiryPercent,omitempty"`
+		RateLimitQPS     float64  `yaml:"rateLimitQPS,omitempty"`
+		RateLimitBurst   float64  `yaml:"rateLimitBurst,omitempty"`
+		RRLQPS           float64  `yaml:"rrlQPS,omitempty"`
+		RRLBurst         float64  `yaml:"rrlBurst,omitempty"`
+		RefuseAny        bool     `yaml:"refuseAny,omitempty"`
+		QueryLogFile     string   `yaml:"queryLogFile,omitempty"`
+		QueryLogSize     int      `yaml:"queryLogSize,omitempty"`
+		QueryLogBackups  int      `yaml:"queryLogBackups,omitempty"`
+		QueryLogRingSize int      `yaml:"queryLogRingSize,omitempty"`
+		AdminListenAddr  string   `yaml:"adminListenAddr,omitempty"`
+		AdminToken       string   `yaml:"adminToken,omitempty"`
 	} `yaml:"caches,omitempty"`
 }
 
@@ -74,7 +95,32 @@ func startDNSCacheServer(c *cli.Context) error {
 		return err
 	}
 	for _, cache := range config.Caches {
-		err := NewCacheServer(cache.ListenAddrs, cache.DnsServers).start()
+		cacheOptions := DNSCacheOptions{
+			MaxEntries:                  cache.MaxEntries,
+			MinTTL:                      cache.MinTTL,
+			MaxTTL:                      cache.MaxTTL,
+			NegativeTTL:                 cache.NegativeTTL,
+			PrefetchEnabled:             cache.Prefetch,
+			PrefetchMinHits:             cache.PrefetchMinHits,
+			PrefetchBeforeExpiryPercent: cache.PrefetchPercent,
+		}
+		serverOptions := CacheServerOptions{
+			Strategy:       cache.UpstreamStrategy,
+			Cooldown:       time.Duration(cache.UpstreamCooldown) * time.Second,
+			RateLimitQPS:   cache.RateLimitQPS,
+			RateLimitBurst: cache.RateLimitBurst,
+			RRLQPS:         cache.RRLQPS,
+			RRLBurst:       cache.RRLBurst,
+			RefuseAny:      cache.RefuseAny,
+
+			QueryLogFile:      cache.QueryLogFile,
+			QueryLogMaxSizeMB: cache.QueryLogSize,
+			QueryLogBackups:   cache.QueryLogBackups,
+			QueryLogRingSize:  cache.QueryLogRingSize,
+			AdminAddr:         cache.AdminListenAddr,
+			AdminToken:        cache.AdminToken,
+		}
+		err := NewCacheServer(cache.ListenAddrs, cache.DnsServers, cacheOptions, serverOptions).start()
 		if err != nil {
 			return err
 		}
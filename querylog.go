@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const defaultQueryLogRingSize = 1000
+
+// QueryLogEntry records everything CacheServer knows about one processed
+// request.
+type QueryLogEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	QName     string    `json:"qname"`
+	QType     string    `json:"qtype"`
+	Rcode     string    `json:"rcode"`
+	Answer    string    `json:"answer,omitempty"`
+	Upstream  string    `json:"upstream,omitempty"`
+	ElapsedMs float64   `json:"elapsedMs"`
+	CacheHit  bool      `json:"cacheHit"`
+}
+
+// QueryLogStats summarizes query volume since startup.
+type QueryLogStats struct {
+	Total     int64 `json:"total"`
+	CacheHits int64 `json:"cacheHits"`
+	Errors    int64 `json:"errors"`
+}
+
+// QueryLog keeps an in-memory ring buffer of the most recent queries for
+// the admin HTTP endpoints, and optionally persists every query to a
+// rotating JSONL file.
+type QueryLog struct {
+	mu    sync.Mutex
+	ring  []QueryLogEntry
+	pos   int
+	count int
+
+	writer io.Writer
+
+	total     int64
+	cacheHits int64
+	errors    int64
+}
+
+// NewQueryLog creates a QueryLog keeping the last ringSize entries in
+// memory. When logFile is non-empty, every entry is also appended to it as
+// rotating JSONL, reusing the same lumberjack rotation as the main log.
+func NewQueryLog(logFile string, maxSizeMB int, backups int, ringSize int) *QueryLog {
+	if ringSize <= 0 {
+		ringSize = defaultQueryLogRingSize
+	}
+
+	ql := &QueryLog{ring: make([]QueryLogEntry, ringSize)}
+	if logFile != "" {
+		ql.writer = &lumberjack.Logger{Filename: logFile, LocalTime: true, MaxSize: maxSizeMB, MaxBackups: backups}
+	}
+	return ql
+}
+
+// Record appends entry to the ring buffer and, if configured, the JSONL log
+// file.
+func (ql *QueryLog) Record(entry QueryLogEntry) {
+	atomic.AddInt64(&ql.total, 1)
+	if entry.CacheHit {
+		atomic.AddInt64(&ql.cacheHits, 1)
+	}
+	if entry.Rcode != dns.RcodeToString[dns.RcodeSuccess] {
+		atomic.AddInt64(&ql.errors, 1)
+	}
+
+	ql.mu.Lock()
+	ql.ring[ql.pos] = entry
+	ql.pos = (ql.pos + 1) % len(ql.ring)
+	if ql.count < len(ql.ring) {
+		ql.count++
+	}
+	ql.mu.Unlock()
+
+	if ql.writer != nil {
+		if data, err := json.Marshal(entry); err == nil {
+			ql.writer.Write(append(data, '\n'))
+		}
+	}
+}
+
+// Recent returns the entries currently held in the ring buffer, oldest
+// first.
+func (ql *QueryLog) Recent() []QueryLogEntry {
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+
+	result := make([]QueryLogEntry, 0, ql.count)
+	if ql.count < len(ql.ring) {
+		return append(result, ql.ring[:ql.count]...)
+	}
+	result = append(result, ql.ring[ql.pos:]...)
+	result = append(result, ql.ring[:ql.pos]...)
+	return result
+}
+
+// Stats returns the running query counters.
+func (ql *QueryLog) Stats() QueryLogStats {
+	return QueryLogStats{
+		Total:     atomic.LoadInt64(&ql.total),
+		CacheHits: atomic.LoadInt64(&ql.cacheHits),
+		Errors:    atomic.LoadInt64(&ql.errors),
+	}
+}
+
+// answerSummary renders a short, human-readable summary of resp's answer
+// section for the query log.
+func answerSummary(resp *dns.Msg) string {
+	if resp == nil || len(resp.Answer) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(resp.Answer))
+	for _, rr := range resp.Answer {
+		parts = append(parts, rr.String())
+	}
+	return strings.Join(parts, "; ")
+}
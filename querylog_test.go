@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestQueryLogRecentWrapsAroundInOrder(t *testing.T) {
+	ql := NewQueryLog("", 0, 0, 3)
+
+	for _, name := range []string{"a.", "b.", "c.", "d.", "e."} {
+		ql.Record(QueryLogEntry{QName: name, Rcode: "NOERROR"})
+	}
+
+	recent := ql.Recent()
+	names := make([]string, len(recent))
+	for i, e := range recent {
+		names[i] = e.QName
+	}
+
+	want := []string{"c.", "d.", "e."}
+	if len(names) != len(want) {
+		t.Fatalf("expected %d entries after wrapping past a ring size of 3, got %d: %v", len(want), len(names), names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("expected oldest-first order %v, got %v", want, names)
+		}
+	}
+}
+
+func TestQueryLogRecentBeforeRingFills(t *testing.T) {
+	ql := NewQueryLog("", 0, 0, 3)
+
+	ql.Record(QueryLogEntry{QName: "a.", Rcode: "NOERROR"})
+	ql.Record(QueryLogEntry{QName: "b.", Rcode: "NOERROR"})
+
+	recent := ql.Recent()
+	if len(recent) != 2 || recent[0].QName != "a." || recent[1].QName != "b." {
+		t.Fatalf("expected [a. b.] before the ring fills, got %v", recent)
+	}
+}
+
+func TestQueryLogStatsCountsHitsAndErrors(t *testing.T) {
+	ql := NewQueryLog("", 0, 0, 10)
+
+	ql.Record(QueryLogEntry{Rcode: "NOERROR", CacheHit: true})
+	ql.Record(QueryLogEntry{Rcode: "NOERROR", CacheHit: false})
+	ql.Record(QueryLogEntry{Rcode: "SERVFAIL", CacheHit: false})
+
+	stats := ql.Stats()
+	if stats.Total != 3 {
+		t.Fatalf("expected Total 3, got %d", stats.Total)
+	}
+	if stats.CacheHits != 1 {
+		t.Fatalf("expected CacheHits 1, got %d", stats.CacheHits)
+	}
+	if stats.Errors != 1 {
+		t.Fatalf("expected Errors 1, got %d", stats.Errors)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// bucketIdleTimeout is how long a per-key token bucket can sit unused
+// before it is swept, so RateLimiter doesn't grow without bound as new
+// clients or query patterns come and go.
+const bucketIdleTimeout = 10 * time.Minute
+
+// tokenBucket is a classic token-bucket rate limiter: tokens refill
+// continuously at rate per second up to max, and each Allow call spends
+// one token.
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	max      float64
+	rate     float64
+	last     time.Time
+	lastUsed time.Time
+}
+
+func newTokenBucket(rate float64, max float64) *tokenBucket {
+	now := time.Now()
+	return &tokenBucket{tokens: max, max: max, rate: rate, last: now, lastUsed: now}
+}
+
+func (tb *tokenBucket) Allow() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.max {
+		tb.tokens = tb.max
+	}
+	tb.last = now
+	tb.lastUsed = now
+
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+func (tb *tokenBucket) idleSince(now time.Time) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return now.Sub(tb.lastUsed)
+}
+
+// RateLimiter hands out a token bucket per key (e.g. a client IP, or a
+// client/qname/qtype tuple for Response Rate Limiting) and evicts buckets
+// that have gone idle.
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	qps     float64
+	burst   float64
+}
+
+// NewRateLimiter creates a limiter allowing qps queries per second per key,
+// with bursts up to burst tokens.
+func NewRateLimiter(qps float64, burst float64) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	rl := &RateLimiter{buckets: make(map[string]*tokenBucket), qps: qps, burst: burst}
+	go rl.sweepLoop()
+	return rl
+}
+
+// Allow reports whether a query for key is within its rate limit.
+func (rl *RateLimiter) Allow(key string) bool {
+	rl.mu.Lock()
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = newTokenBucket(rl.qps, rl.burst)
+		rl.buckets[key] = bucket
+	}
+	rl.mu.Unlock()
+
+	return bucket.Allow()
+}
+
+func (rl *RateLimiter) sweepLoop() {
+	ticker := time.NewTicker(bucketIdleTimeout)
+	defer ticker.Stop()
+	for range ticker.C {
+		rl.sweep()
+	}
+}
+
+func (rl *RateLimiter) sweep() {
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for key, bucket := range rl.buckets {
+		if bucket.idleSince(now) > bucketIdleTimeout {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// clientIP extracts the requesting client's address from a
+// dns.ResponseWriter's remote address.
+func clientIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		return net.ParseIP(host)
+	}
+}
+
+// clientPrefix collapses ip down to the network prefix RRL keys on: a /24
+// for IPv4 clients, a /56 for IPv6 ones.
+func clientPrefix(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.To16().Mask(net.CIDRMask(56, 128)).String()
+}
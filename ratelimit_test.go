@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketAllowsBurstThenBlocksUntilRefill(t *testing.T) {
+	tb := newTokenBucket(0, 2)
+
+	if !tb.Allow() || !tb.Allow() {
+		t.Fatalf("expected the initial burst of 2 tokens to be allowed")
+	}
+	if tb.Allow() {
+		t.Fatalf("expected a third immediate call to be blocked with no refill (rate 0)")
+	}
+}
+
+func TestTokenBucketRefillsOverTimeClampedToMax(t *testing.T) {
+	tb := newTokenBucket(10, 1)
+	tb.Allow() // drain the only token
+
+	tb.mu.Lock()
+	tb.last = tb.last.Add(-time.Second)
+	tb.mu.Unlock()
+
+	if !tb.Allow() {
+		t.Fatalf("expected a second's worth of refill at 10/s to allow another call")
+	}
+
+	tb.mu.Lock()
+	tb.last = tb.last.Add(-10 * time.Second)
+	tb.mu.Unlock()
+	tb.Allow()
+	tb.mu.Lock()
+	tokens := tb.tokens
+	tb.mu.Unlock()
+	if tokens > tb.max {
+		t.Fatalf("expected tokens to clamp to max %v, got %v", tb.max, tokens)
+	}
+}
+
+func TestRateLimiterSweepEvictsIdleBuckets(t *testing.T) {
+	rl := &RateLimiter{buckets: map[string]*tokenBucket{"client": newTokenBucket(1, 1)}, qps: 1, burst: 1}
+
+	rl.buckets["client"].lastUsed = time.Now().Add(-2 * bucketIdleTimeout)
+	rl.sweep()
+
+	if _, ok := rl.buckets["client"]; ok {
+		t.Fatalf("expected an idle bucket to be swept")
+	}
+}
+
+func TestRateLimiterKeepsActiveBuckets(t *testing.T) {
+	rl := &RateLimiter{buckets: map[string]*tokenBucket{"client": newTokenBucket(1, 1)}, qps: 1, burst: 1}
+
+	rl.sweep()
+
+	if _, ok := rl.buckets["client"]; !ok {
+		t.Fatalf("expected a recently used bucket to survive a sweep")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+)
+
+// singleflightCall is one in-flight (or completed) call shared by every
+// caller that asked for the same key.
+type singleflightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// singleflightGroup deduplicates concurrent identical calls so only one of
+// them actually runs; the rest wait for and share its result. This is what
+// keeps prefetch refreshes from racing a live cache-miss query for the
+// same name.
+type singleflightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*singleflightCall
+}
+
+func newSingleflightGroup() *singleflightGroup {
+	return &singleflightGroup{calls: make(map[string]*singleflightCall)}
+}
+
+// Do runs fn for key, or waits for and returns the result of a call already
+// in flight for the same key.
+func (g *singleflightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.val, call.err
+	}
+
+	call := &singleflightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.val, call.err = fn()
+	call.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return call.val, call.err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// failThreshold is the number of consecutive failures an upstream must
+// accumulate before it is put into cooldown.
+const failThreshold = 3
+
+// upstreamHealth tracks the recent health of a single upstream DNSServer:
+// consecutive failures, an optional cooldown window during which the
+// upstream is skipped, and an EWMA of its response latency used by the
+// "fastest" fanout strategy.
+type upstreamHealth struct {
+	mu               sync.Mutex
+	consecutiveFails int
+	cooldownUntil    time.Time
+	latency          time.Duration
+}
+
+func newUpstreamHealth() *upstreamHealth {
+	return &upstreamHealth{}
+}
+
+// recordSuccess clears any failure streak and folds latency into the
+// running EWMA.
+func (h *upstreamHealth) recordSuccess(latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.consecutiveFails = 0
+	h.cooldownUntil = time.Time{}
+	if h.latency == 0 {
+		h.latency = latency
+	} else {
+		h.latency += (latency - h.latency) / 4
+	}
+}
+
+// recordFailure counts a failed exchange, putting the upstream into
+// cooldown for the given duration once failThreshold is reached.
+func (h *upstreamHealth) recordFailure(cooldown time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.consecutiveFails++
+	if h.consecutiveFails >= failThreshold {
+		h.cooldownUntil = time.Now().Add(cooldown)
+	}
+}
+
+// available reports whether the upstream's cooldown, if any, has expired.
+func (h *upstreamHealth) available() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return time.Now().After(h.cooldownUntil)
+}
+
+// avgLatency returns the current EWMA latency, or a large placeholder for
+// an upstream that has never answered successfully yet.
+func (h *upstreamHealth) avgLatency() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.latency == 0 {
+		return time.Hour
+	}
+	return h.latency
+}
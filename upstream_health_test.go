@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpstreamHealthAvgLatencyTracksEWMA(t *testing.T) {
+	h := newUpstreamHealth()
+
+	if got := h.avgLatency(); got != time.Hour {
+		t.Fatalf("expected the placeholder latency of 1h before any success, got %v", got)
+	}
+
+	h.recordSuccess(100 * time.Millisecond)
+	if got := h.avgLatency(); got != 100*time.Millisecond {
+		t.Fatalf("expected the first sample to seed the EWMA directly, got %v", got)
+	}
+
+	h.recordSuccess(500 * time.Millisecond)
+	if got := h.avgLatency(); got <= 100*time.Millisecond || got >= 500*time.Millisecond {
+		t.Fatalf("expected the EWMA to move toward, but not jump to, the new sample; got %v", got)
+	}
+}
+
+func TestUpstreamHealthCooldownAfterFailThreshold(t *testing.T) {
+	h := newUpstreamHealth()
+
+	for i := 0; i < failThreshold-1; i++ {
+		h.recordFailure(time.Minute)
+		if !h.available() {
+			t.Fatalf("expected the upstream to stay available before reaching failThreshold")
+		}
+	}
+
+	h.recordFailure(time.Minute)
+	if h.available() {
+		t.Fatalf("expected the upstream to be in cooldown after failThreshold consecutive failures")
+	}
+
+	h.recordSuccess(10 * time.Millisecond)
+	if !h.available() {
+		t.Fatalf("expected a success to clear the cooldown")
+	}
+}